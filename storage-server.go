@@ -2,8 +2,15 @@ package main
 
 import (
 	"bytes"
+	"container/heap"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
@@ -15,157 +22,1207 @@ import (
 
 const MEGABYTES = 1000000 // in bytes
 
-var cachedStore = &cachedFs{
-	cache:         map[string]*cachedEntry{},
-	maxSizeBytes:  15 * MEGABYTES,
-	writeInterval: 10 * time.Second,
-}
+// longPollTimeout bounds how long a GET with ?wait set can block waiting for
+// a write to the requested path before falling back to serving whatever is
+// there already.
+const longPollTimeout = 30 * time.Second
+
+// caches holds one cachedFs per namespace, keyed by the URL prefix that
+// routes to it (e.g. "drawings", "images", "library"). It is populated by
+// loadCaches before Start/ListenAndServe run.
+var caches = map[string]*cachedFs{}
+
+// defaultNamespace is served for any request whose first path segment
+// doesn't match a configured namespace, preserving the original
+// cwd-relative behavior of this server.
+const defaultNamespace = ""
 
 func mainRoute(w http.ResponseWriter, req *http.Request) {
 	// Always enable CORS
 	w.Header().Add("Access-Control-Allow-Origin", "*")
 
 	pathFromUrl, _ := strings.CutPrefix(req.URL.Path, "/")
-	absolutePathInFilesystem, _ := filepath.Abs(pathFromUrl)
-	workingDirectory, _ := os.Getwd()
+	namespace, rest := routeNamespace(pathFromUrl)
+
+	store, exists := caches[namespace]
+	if !exists {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	absolutePathInFilesystem, _ := filepath.Abs(filepath.Join(store.dir, rest))
+	baseDir, _ := filepath.Abs(store.dir)
 
-	if pathFromUrl == "" || !strings.HasPrefix(absolutePathInFilesystem, workingDirectory) {
+	if rest == "" || !strings.HasPrefix(absolutePathInFilesystem, baseDir) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	if casRest, isCAS := strings.CutPrefix(rest, store.casPrefix+"/"); isCAS && store.casPrefix != "" {
+		handleCAS(w, req, store, casRest, absolutePathInFilesystem)
+		return
+	}
+
 	if strings.ToUpper(req.Method) == "GET" {
-		data, _ := cachedStore.Read(absolutePathInFilesystem)
-		io.Copy(w, data)
+		if req.URL.Query().Has("wait") {
+			// Long-poll: block until a collaborator's POST lands (or we time
+			// out) before reading, so the client gets the update pushed to
+			// it instead of having to tight-poll for changes.
+			ch, cancel := store.subscribe(absolutePathInFilesystem)
+			select {
+			case <-ch:
+			case <-time.After(longPollTimeout):
+				cancel()
+			case <-req.Context().Done():
+				cancel()
+				return
+			}
+		}
+
+		blob, modTime, err := store.Read(absolutePathInFilesystem)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		defer blob.Close()
+
+		http.ServeContent(w, req, filepath.Base(absolutePathInFilesystem), modTime, io.NewSectionReader(blob, 0, blob.Size()))
 		return
 	}
 
 	if strings.ToUpper(req.Method) == "POST" {
 		defer req.Body.Close()
-		cachedStore.Write(absolutePathInFilesystem, req.Body)
+		if err := store.Write(absolutePathInFilesystem, req.Body); err != nil {
+			log.Printf("write \"%s\": %s\n", absolutePathInFilesystem, err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
+
+// routeNamespace picks the cache namespace for a request path: the first
+// path segment if it names a configured namespace, otherwise the
+// defaultNamespace with the whole path as the remainder.
+func routeNamespace(pathFromUrl string) (namespace string, rest string) {
+	segment, remainder, found := strings.Cut(pathFromUrl, "/")
+	if found {
+		if _, exists := caches[segment]; exists {
+			return segment, remainder
+		}
+	} else if _, exists := caches[segment]; exists {
+		return segment, ""
+	}
+	return defaultNamespace, pathFromUrl
+}
+
+// keyedMutex hands out one mutex per key, so callers serialize against each
+// other only when they share a key. Unused locks are removed once nobody is
+// waiting on them, so the map doesn't grow without bound for a server that
+// sees an ever-changing set of paths.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refcountedMutex
+}
+
+type refcountedMutex struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: map[string]*refcountedMutex{}}
+}
+
+// Lock blocks until the caller holds the lock for key, and returns a func
+// that releases it. Callers are expected to `defer unlock()`.
+func (k *keyedMutex) Lock(key string) (unlock func()) {
+	k.mu.Lock()
+	entry, exists := k.locks[key]
+	if !exists {
+		entry = &refcountedMutex{}
+		k.locks[key] = entry
+	}
+	entry.refs++
+	k.mu.Unlock()
+
+	entry.mu.Lock()
+
+	return func() {
+		entry.mu.Unlock()
+
+		k.mu.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// casPointer is the small on-disk file left at the path a client POSTed to
+// under a CAS-backed prefix, in place of the actual bytes. Two drawings
+// that embed the same image end up with two pointer files referencing the
+// same deduplicated blob.
+type casPointer struct {
+	Sha256 string `json:"sha256"`
+}
+
+// handleCAS serves the content-addressed storage routes for a single
+// namespace: POSTing under the namespace's casPrefix dedups the body by
+// SHA-256 and leaves a casPointer at the requested path, GET dereferences
+// that pointer, and HEAD checks whether a digest is already stored so a
+// client can skip re-uploading a blob it already knows the hash of.
+func handleCAS(w http.ResponseWriter, req *http.Request, store *cachedFs, casRest string, pointerPath string) {
+	switch strings.ToUpper(req.Method) {
+	case "HEAD":
+		if !store.HasCAS(casRest) {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+	case "POST":
+		defer req.Body.Close()
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		sum := sha256.Sum256(data)
+		digest := hex.EncodeToString(sum[:])
+
+		// Hold the digest as referenced from before the blob lands in casDir
+		// until after the pointer that references it is durably written, so
+		// gcCAS can never observe it as an orphan blob in between.
+		release := store.protectCAS(digest)
+		defer release()
+
+		if _, err := store.PutCAS(data); err != nil {
+			log.Printf("cas: error storing blob for \"%s\": %s\n", pointerPath, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		pointer, err := json.Marshal(casPointer{Sha256: digest})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := atomicWriteFile(pointerPath, pointer); err != nil {
+			log.Printf("cas: error writing pointer \"%s\": %s\n", pointerPath, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprint(w, digest)
+
+	case "GET":
+		raw, err := os.ReadFile(pointerPath)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var pointer casPointer
+		if err := json.Unmarshal(raw, &pointer); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		blob, err := store.GetCAS(pointer.Sha256)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		defer blob.Close()
+
+		http.ServeContent(w, req, filepath.Base(pointerPath), time.Time{}, io.NewSectionReader(blob, 0, blob.Size()))
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
 type cachedFs struct {
 	cache         map[string]*cachedEntry
+	evictable     evictionHeap // entries that are safe to evict, i.e. not dirty
+	totalBytes    uint64       // kept in sync with cache on every insert/evict, never recomputed by scanning
 	rwlock        sync.RWMutex
+	dir           string
 	maxSizeBytes  uint64
+	maxEntries    int
 	writeInterval time.Duration
+	maxAge        time.Duration // -1: never expire, 0: caching disabled, >0: TTL enforced by the janitor
+
+	// inMemoryThresholdBytes caps how large a write can be before it skips
+	// the in-memory cache entirely and is served straight from disk as a
+	// fileBlob instead of being buffered into a byteBlob.
+	inMemoryThresholdBytes uint64
+
+	walPath string
+	walFile *os.File
+
+	// pathLocks serializes Read/Write around the same path so that
+	// concurrent writers to one key don't interleave, and concurrent cold
+	// readers of one key coalesce onto a single disk read instead of each
+	// re-reading and re-inserting into the cache independently.
+	pathLocks *keyedMutex
+
+	// notifyMu guards waiters, which lets a long-polling GET block in
+	// subscribe until the next successful Write to the same path instead of
+	// the client having to re-poll, so collaborators see each other's edits
+	// as soon as they land.
+	notifyMu sync.Mutex
+	waiters  map[string][]chan struct{}
+
+	// CAS (content-addressed storage) support, for deduplicating blobs
+	// (e.g. images) referenced from several documents. casPrefix is the URL
+	// path segment (relative to dir) that routes to handleCAS; empty
+	// disables CAS for this namespace. casDir holds the deduplicated blobs
+	// themselves, keyed by digest, separate from the pointer files that
+	// live under dir/casPrefix.
+	casPrefix     string
+	casDir        string
+	casGCInterval time.Duration
+
+	// casInflight counts, per digest, uploads that have written the blob
+	// but not yet written the pointer that references it. gcCAS treats any
+	// digest in here as referenced, so it can never collect a blob in the
+	// window between PutCAS and the pointer file landing on disk.
+	casMu       sync.Mutex
+	casInflight map[string]int
+
+	// casGCCandidates holds the digests the previous gcCAS pass found
+	// unreferenced; a digest is only actually deleted once it's turned up
+	// unreferenced on two passes in a row. See gcCAS for why.
+	casGCCandidates map[string]bool
+}
+
+// Blob is a handle to a stored value that doesn't force it to be buffered
+// in memory to be served: mainRoute hands it to http.ServeContent, so
+// conditional GETs, Range requests and Last-Modified all work regardless of
+// whether the backing bytes live in RAM or on disk.
+type Blob interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// byteBlob serves a small, hot entry straight out of the in-memory cache.
+type byteBlob struct {
+	data []byte
 }
 
+func (b *byteBlob) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(b.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *byteBlob) Close() error { return nil }
+func (b *byteBlob) Size() int64  { return int64(len(b.data)) }
+
+// fileBlob serves an entry that's too large (or whose namespace has
+// caching disabled) to be worth holding in RAM; it reads straight from the
+// on-disk copy through an open file handle.
+type fileBlob struct {
+	file *os.File
+	size int64
+}
+
+func (b *fileBlob) ReadAt(p []byte, off int64) (int, error) { return b.file.ReadAt(p, off) }
+func (b *fileBlob) Close() error                            { return b.file.Close() }
+func (b *fileBlob) Size() int64                             { return b.size }
+
 type cachedEntry struct {
+	key                    string
 	accessCount            int
 	data                   []byte
 	needsToBeWrittenOnDisk bool
 	lastModifiedTime       time.Time
+	heapIndex              int // index into evictable, maintained by container/heap; -1 when not in the heap
+}
+
+// evictionHeap is a segmented-LFU-with-LRU-tiebreaker min-heap: the entry at
+// the top is the best eviction candidate (fewest accesses, then oldest).
+// Dirty entries (needsToBeWrittenOnDisk) are never placed in the heap, so
+// eviction can never drop unsaved data.
+type evictionHeap []*cachedEntry
+
+func (h evictionHeap) Len() int { return len(h) }
+
+func (h evictionHeap) Less(i, j int) bool {
+	if h[i].accessCount != h[j].accessCount {
+		return h[i].accessCount < h[j].accessCount
+	}
+	return h[i].lastModifiedTime.Before(h[j].lastModifiedTime)
+}
+
+func (h evictionHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *evictionHeap) Push(x any) {
+	entry := x.(*cachedEntry)
+	entry.heapIndex = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *evictionHeap) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.heapIndex = -1
+	*h = old[:n-1]
+	return entry
+}
+
+// markEvictable adds an entry to the eviction heap. Must be called with
+// c.rwlock held for writing.
+func (c *cachedFs) markEvictable(entry *cachedEntry) {
+	if entry.heapIndex != -1 {
+		return
+	}
+	heap.Push(&c.evictable, entry)
+}
+
+// markDirty removes an entry from the eviction heap, protecting it from
+// eviction until it has been persisted to disk. Must be called with
+// c.rwlock held for writing.
+func (c *cachedFs) markDirty(entry *cachedEntry) {
+	if entry.heapIndex == -1 {
+		return
+	}
+	heap.Remove(&c.evictable, entry.heapIndex)
+}
+
+// touch records a read of entry, bumping its accessCount and re-settling its
+// position in the eviction heap so the LFU signal actually reflects read
+// traffic instead of only writes. Must be called with c.rwlock held for
+// writing.
+func (c *cachedFs) touch(entry *cachedEntry) {
+	entry.accessCount++
+	if entry.heapIndex != -1 {
+		heap.Fix(&c.evictable, entry.heapIndex)
+	}
+}
+
+// evict removes entries from the cache, cheapest-to-lose first, until
+// adding addBytes more bytes would fit within maxSizeBytes and maxEntries.
+// Must be called with c.rwlock held for writing.
+func (c *cachedFs) evict(addBytes uint64) {
+	for (c.maxSizeBytes > 0 && c.totalBytes+addBytes > c.maxSizeBytes) ||
+		(c.maxEntries > 0 && len(c.cache) >= c.maxEntries) {
+		if c.evictable.Len() == 0 {
+			// Nothing left that's safe to evict; the cache will grow past
+			// its limits rather than lose unwritten data.
+			return
+		}
+
+		victim := heap.Pop(&c.evictable).(*cachedEntry)
+		c.totalBytes -= uint64(len(victim.data))
+		delete(c.cache, victim.key)
+	}
 }
 
 func (c *cachedFs) Start() {
+	if c.casGCInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(c.casGCInterval)
+				c.gcCAS()
+			}
+		}()
+	}
+
 	go func() {
 		for {
 			time.Sleep(c.writeInterval)
 
 			c.rwlock.Lock()
+			allPersisted := true
 			for fname, data := range c.cache {
 				if data.needsToBeWrittenOnDisk {
-					os.MkdirAll(filepath.Dir(fname), 0755)
-					file, err := os.Create(fname)
-					if err != nil {
-						log.Printf("error while creating file for persisting \"%s\": %s\n", fname, err)
-						continue
-					}
-					defer file.Close()
-
-					_, err = file.Write(data.data)
-					if err != nil {
+					if err := atomicWriteFile(fname, data.data); err != nil {
 						log.Printf("error while persisting \"%s\": %s\n", fname, err)
+						allPersisted = false
 						continue
 					}
 					log.Printf("persisted \"%s\"", fname)
 				}
 				data.needsToBeWrittenOnDisk = false
+				c.markEvictable(data)
+			}
+
+			if allPersisted {
+				if err := c.truncateWAL(); err != nil {
+					log.Printf("wal: error truncating \"%s\": %s\n", c.walPath, err)
+				}
+			}
+
+			if c.maxAge > 0 {
+				for fname, data := range c.cache {
+					if data.needsToBeWrittenOnDisk || time.Since(data.lastModifiedTime) < c.maxAge {
+						continue
+					}
+					c.markDirty(data) // pull out of the heap before it's deleted out from under it
+					c.totalBytes -= uint64(len(data.data))
+					delete(c.cache, fname)
+				}
 			}
 			c.rwlock.Unlock()
 		}
 	}()
 }
 
-func (c *cachedFs) Read(name string) (io.Reader, error) {
+func (c *cachedFs) Read(name string) (Blob, time.Time, error) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, time.Time{}, err
+		}
+
+		// Not on disk yet: it may still be sitting in the cache, durably
+		// logged to the WAL but not due to be flushed for up to
+		// writeInterval. Serve it from memory instead of 404ing on a write
+		// that already succeeded.
+		c.rwlock.RLock()
+		contents, exists := c.cache[name]
+		c.rwlock.RUnlock()
+		if !exists {
+			return nil, time.Time{}, err
+		}
+
+		c.rwlock.Lock()
+		c.touch(contents)
+		c.rwlock.Unlock()
+		return &byteBlob{data: contents.data}, contents.lastModifiedTime, nil
+	}
+	modifiedTime := stat.ModTime()
+
+	if c.maxAge == 0 || uint64(stat.Size()) > c.inMemoryThresholdBytes {
+		// Too big to be worth buffering, or caching is off for this
+		// namespace: stream straight from disk instead of going through
+		// the in-memory cache.
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return &fileBlob{file: file, size: stat.Size()}, modifiedTime, nil
+	}
+
 	c.rwlock.RLock()
 	contents, exists := c.cache[name]
 	c.rwlock.RUnlock()
 
-	stat, err := os.Stat(name)
-	if err != nil {
-		return nil, err
+	if exists && !modifiedTime.After(contents.lastModifiedTime) {
+		c.rwlock.Lock()
+		c.touch(contents)
+		c.rwlock.Unlock()
+		return &byteBlob{data: contents.data}, contents.lastModifiedTime, nil
 	}
-	modifiedTime := stat.ModTime()
+
+	// Cold or stale: serialize on this path so concurrent readers of the
+	// same cold key coalesce onto a single disk read instead of each
+	// re-reading the file and racing to populate the cache.
+	unlock := c.pathLocks.Lock(name)
+	defer unlock()
+
+	c.rwlock.RLock()
+	contents, exists = c.cache[name]
+	c.rwlock.RUnlock()
 
 	if !exists || modifiedTime.After(contents.lastModifiedTime) {
 		file, err := os.Open(name)
 		defer file.Close()
 		if err != nil {
-			return nil, err
+			return nil, time.Time{}, err
 		}
 
 		filecontents, err := io.ReadAll(file)
 		if err != nil {
-			return nil, err
+			return nil, time.Time{}, err
 		}
 
 		c.rwlock.Lock()
 		contents = &cachedEntry{
+			key:                    name,
 			accessCount:            1,
 			data:                   filecontents,
 			needsToBeWrittenOnDisk: false,
 			lastModifiedTime:       modifiedTime,
+			heapIndex:              -1,
 		}
+		c.evict(uint64(len(filecontents)))
 		c.cache[name] = contents
+		c.totalBytes += uint64(len(filecontents))
+		c.markEvictable(contents)
+		c.rwlock.Unlock()
+	} else {
+		// Another reader populated or refreshed the cache while we waited
+		// for the path lock; this is still a hit for us.
+		c.rwlock.Lock()
+		c.touch(contents)
 		c.rwlock.Unlock()
 	}
 
-	return io.NopCloser(bytes.NewBuffer(contents.data)), nil
+	return &byteBlob{data: contents.data}, contents.lastModifiedTime, nil
 }
 
 func (c *cachedFs) Write(name string, contents io.Reader) error {
-	var sizeBytes uint64 = 0
-
-	c.rwlock.RLock()
-	for _, v := range c.cache {
-		sizeBytes += uint64(len(v.data))
-	}
-	oldAccessCount := 0
-	if oldContents, exists := c.cache[name]; exists {
-		oldAccessCount = oldContents.accessCount
+	buf, err := io.ReadAll(contents)
+	if err != nil {
+		return err
 	}
 
-	c.rwlock.RUnlock()
+	// Serialize the whole read-modify-write against this path: two POSTs to
+	// the same key now apply in some well-defined order instead of racing
+	// to be the last one to grab c.rwlock, and a concurrent Read of the
+	// same path either fully precedes or fully follows this write.
+	unlock := c.pathLocks.Lock(name)
+	defer unlock()
 
-	if sizeBytes > c.maxSizeBytes {
+	if c.maxAge == 0 || uint64(len(buf)) > c.inMemoryThresholdBytes {
+		// Caching disabled for this namespace, or the blob is too big to be
+		// worth buffering: write straight through to disk and drop any
+		// smaller cached copy of the same path it might be replacing.
 		c.rwlock.Lock()
-		// TODO
+		if oldContents, exists := c.cache[name]; exists {
+			c.markDirty(oldContents)
+			c.totalBytes -= uint64(len(oldContents.data))
+			delete(c.cache, name)
+		}
 		c.rwlock.Unlock()
+		if err := atomicWriteFile(name, buf); err != nil {
+			return err
+		}
+		c.notify(name)
+		return nil
 	}
 
-	buf, err := io.ReadAll(contents)
-	if err != nil {
+	c.rwlock.Lock()
+	defer c.rwlock.Unlock()
+
+	// Durably log the write before it's visible anywhere, so a crash right
+	// after this handler returns 200 can never lose it.
+	if err := c.appendWAL(name, buf); err != nil {
 		return err
 	}
 
-	c.rwlock.Lock()
+	oldAccessCount := 0
+	if oldContents, exists := c.cache[name]; exists {
+		oldAccessCount = oldContents.accessCount
+		c.markDirty(oldContents)
+		c.totalBytes -= uint64(len(oldContents.data))
+		delete(c.cache, name)
+	}
+
+	c.evict(uint64(len(buf)))
+
 	c.cache[name] = &cachedEntry{
+		key:                    name,
 		accessCount:            oldAccessCount + 1,
 		data:                   buf,
 		needsToBeWrittenOnDisk: true,
 		lastModifiedTime:       time.Now(),
+		heapIndex:              -1,
 	}
-	c.rwlock.Unlock()
+	c.totalBytes += uint64(len(buf))
 
+	c.notify(name)
 	return nil
 }
 
+// subscribe returns a channel that's closed the next time name is
+// successfully written, so a long-polling GET can block on it instead of
+// the client having to re-poll for a collaborator's edit. The returned
+// cancel func deregisters the channel again; callers that give up waiting
+// (timeout or client disconnect) must call it so an idle document's waiter
+// list doesn't grow forever.
+func (c *cachedFs) subscribe(name string) (ch <-chan struct{}, cancel func()) {
+	waiter := make(chan struct{})
+
+	c.notifyMu.Lock()
+	c.waiters[name] = append(c.waiters[name], waiter)
+	c.notifyMu.Unlock()
+
+	cancel = func() {
+		c.notifyMu.Lock()
+		defer c.notifyMu.Unlock()
+
+		waiters := c.waiters[name]
+		for i, w := range waiters {
+			if w == waiter {
+				waiters = append(waiters[:i:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(c.waiters, name)
+		} else {
+			c.waiters[name] = waiters
+		}
+	}
+
+	return waiter, cancel
+}
+
+// notify wakes every caller currently blocked in subscribe(name).
+func (c *cachedFs) notify(name string) {
+	c.notifyMu.Lock()
+	waiters := c.waiters[name]
+	delete(c.waiters, name)
+	c.notifyMu.Unlock()
+
+	for _, ch := range waiters {
+		close(ch)
+	}
+}
+
+// isValidDigest reports whether digest is a well-formed, lowercase SHA-256
+// hex string. casPath joins digest straight onto a filesystem path, so
+// anything else (e.g. "../other-doc") must be rejected before it gets near
+// filepath.Join, or a crafted digest can walk back out of casDir.
+func isValidDigest(digest string) bool {
+	if len(digest) != sha256.Size*2 {
+		return false
+	}
+	for _, r := range digest {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// casPath returns the on-disk path for a digest, sharded by its first two
+// hex characters so a single directory never ends up with one entry per
+// blob in the whole store. It returns "" for anything that isn't a
+// well-formed SHA-256 hex digest.
+func (c *cachedFs) casPath(digest string) string {
+	if !isValidDigest(digest) {
+		return ""
+	}
+	return filepath.Join(c.casDir, digest[:2], digest[2:])
+}
+
+// PutCAS stores data once, keyed by its SHA-256 digest, and returns that
+// digest. A second PutCAS of the same bytes is a cheap no-op: the blob is
+// already there.
+func (c *cachedFs) PutCAS(data []byte) (digest string, err error) {
+	sum := sha256.Sum256(data)
+	digest = hex.EncodeToString(sum[:])
+
+	if _, err := os.Stat(c.casPath(digest)); err == nil {
+		return digest, nil
+	}
+	return digest, atomicWriteFile(c.casPath(digest), data)
+}
+
+// GetCAS opens the blob stored under digest.
+func (c *cachedFs) GetCAS(digest string) (Blob, error) {
+	path := c.casPath(digest)
+	if path == "" {
+		return nil, fmt.Errorf("cas: %q is not a valid digest", digest)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileBlob{file: file, size: stat.Size()}, nil
+}
+
+// HasCAS reports whether digest is already stored, so a client that hashes
+// a blob locally can skip uploading it entirely.
+func (c *cachedFs) HasCAS(digest string) bool {
+	path := c.casPath(digest)
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// protectCAS marks digest as referenced regardless of whether any pointer
+// file references it yet. Callers must hold it from before PutCAS writes
+// the blob until after the pointer that will reference it is durably
+// written, so gcCAS can never observe the blob as unreferenced in between.
+func (c *cachedFs) protectCAS(digest string) (release func()) {
+	c.casMu.Lock()
+	c.casInflight[digest]++
+	c.casMu.Unlock()
+
+	return func() {
+		c.casMu.Lock()
+		c.casInflight[digest]--
+		if c.casInflight[digest] <= 0 {
+			delete(c.casInflight, digest)
+		}
+		c.casMu.Unlock()
+	}
+}
+
+// gcCAS deletes every blob in casDir that no pointer file under
+// dir/casPrefix has referenced across two consecutive passes. It's run
+// periodically by Start, not after every write, since a pointer can be
+// deleted or overwritten by any plain POST/DELETE-style client and CAS has
+// no refcount of its own.
+//
+// A blob only gets removed once it's shown up unreferenced on two passes in
+// a row (casGCCandidates tracks the previous pass's findings), rather than
+// the first time it looks unreferenced. That grace period, not lock scope,
+// is what keeps gcCAS from racing a concurrent upload: an upload still
+// between PutCAS and its pointer write landing takes far less than a
+// casGCInterval to finish, so even if this pass's scan catches it mid-write,
+// the *next* pass will see the finished pointer and it'll never reach two
+// unreferenced sightings. That lets gcCAS only hold casMu for the brief
+// casInflight snapshot below instead of across the whole directory walk, so
+// a scan no longer stalls concurrent CAS uploads (protectCAS) for its
+// duration.
+func (c *cachedFs) gcCAS() {
+	if c.casDir == "" {
+		return
+	}
+
+	c.casMu.Lock()
+	referenced := make(map[string]bool, len(c.casInflight))
+	for digest := range c.casInflight {
+		referenced[digest] = true
+	}
+	c.casMu.Unlock()
+
+	pointerRoot := filepath.Join(c.dir, c.casPrefix)
+	filepath.WalkDir(pointerRoot, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+
+		var pointer casPointer
+		if err := json.Unmarshal(raw, &pointer); err == nil && pointer.Sha256 != "" {
+			referenced[pointer.Sha256] = true
+		}
+		return nil
+	})
+
+	removed := 0
+	stillUnreferenced := map[string]bool{}
+	filepath.WalkDir(c.casDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(c.casDir, path)
+		if err != nil {
+			return nil
+		}
+		digest := strings.ReplaceAll(rel, string(filepath.Separator), "")
+
+		// atomicWriteFile briefly leaves its own ".tmp-*" temp file sitting
+		// next to the real one while it writes and fsyncs; skip anything
+		// that isn't digest-shaped so gcCAS can't mistake that in-progress
+		// write for an unreferenced blob.
+		if !isValidDigest(digest) {
+			return nil
+		}
+
+		if referenced[digest] {
+			return nil
+		}
+
+		if c.casGCCandidates[digest] {
+			os.Remove(path)
+			removed++
+		} else {
+			stillUnreferenced[digest] = true
+		}
+		return nil
+	})
+	c.casGCCandidates = stillUnreferenced
+
+	if removed > 0 {
+		log.Printf("cas: gc removed %d unreferenced blob(s) from \"%s\"\n", removed, c.casDir)
+	}
+}
+
+// atomicWriteFile writes data to name without ever leaving a partially
+// written file behind: it writes to a temp file next to name, fsyncs it,
+// then renames it into place. Rename is atomic on the same filesystem, so a
+// crash mid-write can only ever leave the old contents or the new ones.
+func atomicWriteFile(name string, data []byte) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return os.Rename(tmpName, name)
+}
+
+// writeWALRecord logs a single Write() to the write-ahead log: enough to
+// redo the write (path + bytes) plus a checksum to detect a record that was
+// only partially flushed to disk when the process died.
+//
+// On-disk layout, little-endian, one after another until EOF:
+//
+//	uint32 pathLen | path | uint64 dataLen | data | uint32 crc32(data)
+func writeWALRecord(w io.Writer, path string, data []byte) error {
+	var header bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, uint32(len(path)))
+	header.WriteString(path)
+	binary.Write(&header, binary.LittleEndian, uint64(len(data)))
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, crc32.ChecksumIEEE(data))
+}
+
+// readWALRecord reads one record written by writeWALRecord. It returns
+// io.EOF once the log is exhausted, and a non-nil error for a record that
+// is present but corrupt or truncated (e.g. the tail of a write that was
+// interrupted by a crash) — callers should stop replaying at that point
+// rather than fail the whole log.
+func readWALRecord(r io.Reader) (path string, data []byte, err error) {
+	var pathLen uint32
+	if err := binary.Read(r, binary.LittleEndian, &pathLen); err != nil {
+		return "", nil, err
+	}
+
+	pathBytes := make([]byte, pathLen)
+	if _, err := io.ReadFull(r, pathBytes); err != nil {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+
+	var dataLen uint64
+	if err := binary.Read(r, binary.LittleEndian, &dataLen); err != nil {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+
+	data = make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+
+	var checksum uint32
+	if err := binary.Read(r, binary.LittleEndian, &checksum); err != nil {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	if checksum != crc32.ChecksumIEEE(data) {
+		return "", nil, fmt.Errorf("wal: checksum mismatch for \"%s\"", string(pathBytes))
+	}
+
+	return string(pathBytes), data, nil
+}
+
+// openWAL opens (creating if necessary) the append-only segment file
+// backing c's write-ahead log.
+func (c *cachedFs) openWAL() error {
+	if c.walPath == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.walPath), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(c.walPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	c.walFile = file
+	return nil
+}
+
+// appendWAL durably records a write: the data hits disk (via fsync) before
+// this returns, so a Write() handler can only report success once the
+// change survives a crash. Must be called with c.rwlock held.
+func (c *cachedFs) appendWAL(path string, data []byte) error {
+	if c.walFile == nil {
+		return nil
+	}
+	if err := writeWALRecord(c.walFile, path, data); err != nil {
+		return err
+	}
+	return c.walFile.Sync()
+}
+
+// truncateWAL empties the WAL segment. Safe to call once every entry
+// currently in it has been durably persisted into the tree, since replaying
+// it again would be redundant. Must be called with c.rwlock held.
+func (c *cachedFs) truncateWAL() error {
+	if c.walFile == nil {
+		return nil
+	}
+	if err := c.walFile.Truncate(0); err != nil {
+		return err
+	}
+	_, err := c.walFile.Seek(0, io.SeekStart)
+	return err
+}
+
+// replayWAL applies every record left over from a crash to disk and to the
+// in-memory cache, then truncates the log. Must run before the server
+// starts accepting requests.
+func (c *cachedFs) replayWAL() error {
+	if c.walPath == "" {
+		return nil
+	}
+
+	raw, err := os.ReadFile(c.walPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	r := bytes.NewReader(raw)
+	replayed := 0
+	for {
+		path, data, err := readWALRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("wal: stopping replay of \"%s\" at a partial record: %s\n", c.walPath, err)
+			break
+		}
+
+		if err := atomicWriteFile(path, data); err != nil {
+			log.Printf("wal: error replaying write to \"%s\": %s\n", path, err)
+			continue
+		}
+
+		c.rwlock.Lock()
+		if oldContents, exists := c.cache[path]; exists {
+			// An earlier record for the same path: replace it without
+			// leaving it in the heap or counted in totalBytes.
+			c.markDirty(oldContents)
+			c.totalBytes -= uint64(len(oldContents.data))
+		}
+		c.cache[path] = &cachedEntry{
+			key:                    path,
+			accessCount:            1,
+			data:                   data,
+			needsToBeWrittenOnDisk: false,
+			lastModifiedTime:       time.Now(),
+			heapIndex:              -1,
+		}
+		c.totalBytes += uint64(len(data))
+		c.markEvictable(c.cache[path])
+		c.rwlock.Unlock()
+
+		replayed++
+	}
+
+	if replayed > 0 {
+		log.Printf("wal: replayed %d record(s) from \"%s\"\n", replayed, c.walPath)
+	}
+
+	c.rwlock.Lock()
+	defer c.rwlock.Unlock()
+	return c.truncateWAL()
+}
+
+// namespaceConfig is the on-disk (JSON) shape of one entry in the "caches"
+// object of the config file. Fields an entry omits keep the values from
+// defaultNamespaceConfig. loadCaches also maps a zero maxSizeMegabytes,
+// maxEntries, writeIntervalSeconds or inMemoryThresholdBytes, or an empty
+// walDir, to its built-in default; a zero maxAgeSeconds disables caching.
+type namespaceConfig struct {
+	Dir                    string `json:"dir"`
+	MaxSizeMegabytes       uint64 `json:"maxSizeMegabytes"`
+	MaxEntries             int    `json:"maxEntries"`
+	WriteIntervalSecs      int    `json:"writeIntervalSeconds"`
+	MaxAgeSecs             int    `json:"maxAgeSeconds"` // -1: forever, 0: caching disabled
+	WalDir                 string `json:"walDir"`
+	InMemoryThresholdBytes uint64 `json:"inMemoryThresholdBytes"`
+	CasPrefix              string `json:"casPrefix"` // e.g. "blobs"; empty disables CAS for this namespace
+	CasGCIntervalSecs      int    `json:"casGCIntervalSeconds"`
+}
+
+// serverConfig is the on-disk shape of the whole config file, e.g.:
+//
+//	{
+//	  "caches": {
+//	    "": {"dir": ":dataDir"},
+//	    "drawings": {"dir": ":cacheDir/drawings", "maxAgeSeconds": -1},
+//	    "images": {"dir": ":cacheDir/images", "maxSizeMegabytes": 200},
+//	    "library": {"dir": ":dataDir/library", "maxAgeSeconds": 0}
+//	  }
+//	}
+//
+// Caches is kept as raw JSON per namespace (rather than namespaceConfig
+// directly) so loadCaches can unmarshal each entry onto a pre-filled default
+// namespaceConfig: fields the entry omits keep the default, fields it sets
+// (even to zero) override it.
+type serverConfig struct {
+	Caches map[string]json.RawMessage `json:"caches"`
+}
+
+// defaultNamespaceConfig returns the baseline every namespace is built from
+// before the config file's entry (if any) is merged on top of it. These are
+// the same values the original single-cache server used.
+func defaultNamespaceConfig() namespaceConfig {
+	return namespaceConfig{Dir: ".", MaxSizeMegabytes: 15, WriteIntervalSecs: 10, MaxAgeSecs: -1}
+}
+
+// expandPlaceholders resolves the ":cacheDir" and ":dataDir" placeholders a
+// namespace's "dir" may use, so config files can stay portable across
+// machines. ":cacheDir" defaults to "cache" under the working directory and
+// ":dataDir" to the working directory itself; they can be overridden with
+// EXCALIDRAW_CACHEDIR / EXCALIDRAW_DATADIR.
+func expandPlaceholders(path string) string {
+	cacheDir := os.Getenv("EXCALIDRAW_CACHEDIR")
+	if cacheDir == "" {
+		cacheDir = "cache"
+	}
+	dataDir := os.Getenv("EXCALIDRAW_DATADIR")
+	if dataDir == "" {
+		dataDir = "."
+	}
+
+	path = strings.ReplaceAll(path, ":cacheDir", cacheDir)
+	path = strings.ReplaceAll(path, ":dataDir", dataDir)
+	return path
+}
+
+// loadCaches builds the caches map from the config file named by the
+// EXCALIDRAW_CONFIG env var (JSON; defaults to "excalidraw.json" in the
+// working directory). Missing config or missing entries fall back to the
+// original single-cache behavior: an unnamespaced store rooted at the
+// working directory, keeping the cache in memory forever.
+func loadCaches() {
+	configPath := os.Getenv("EXCALIDRAW_CONFIG")
+	if configPath == "" {
+		configPath = "excalidraw.json"
+	}
+
+	config := map[string]namespaceConfig{
+		defaultNamespace: defaultNamespaceConfig(),
+	}
+
+	if raw, err := os.ReadFile(configPath); err == nil {
+		var fromFile serverConfig
+		if err := json.Unmarshal(raw, &fromFile); err != nil {
+			log.Fatalf("error parsing config \"%s\": %s\n", configPath, err)
+		}
+		for namespace, rawCfg := range fromFile.Caches {
+			namespaceCfg, ok := config[namespace]
+			if !ok {
+				namespaceCfg = defaultNamespaceConfig()
+			}
+			if err := json.Unmarshal(rawCfg, &namespaceCfg); err != nil {
+				log.Fatalf("error parsing cache \"%s\" in config \"%s\": %s\n", namespace, configPath, err)
+			}
+			config[namespace] = namespaceCfg
+		}
+	}
+
+	for namespace, namespaceCfg := range config {
+		writeInterval := time.Duration(namespaceCfg.WriteIntervalSecs) * time.Second
+		if writeInterval <= 0 {
+			writeInterval = 10 * time.Second
+		}
+		maxEntries := namespaceCfg.MaxEntries
+		if maxEntries == 0 {
+			maxEntries = 10000
+		}
+		maxSizeMegabytes := namespaceCfg.MaxSizeMegabytes
+		if maxSizeMegabytes == 0 {
+			maxSizeMegabytes = 15
+		}
+
+		walDir := namespaceCfg.WalDir
+		if walDir == "" {
+			walDir = ":cacheDir/wal"
+		}
+		segmentName := namespace
+		if segmentName == "" {
+			segmentName = "default"
+		}
+
+		inMemoryThreshold := namespaceCfg.InMemoryThresholdBytes
+		if inMemoryThreshold == 0 {
+			inMemoryThreshold = MEGABYTES
+		}
+
+		dir := expandPlaceholders(namespaceCfg.Dir)
+
+		var casDir string
+		if namespaceCfg.CasPrefix != "" {
+			casDir = filepath.Join(dir, ".cas")
+		}
+
+		caches[namespace] = &cachedFs{
+			cache:                  map[string]*cachedEntry{},
+			evictable:              evictionHeap{},
+			pathLocks:              newKeyedMutex(),
+			dir:                    dir,
+			maxSizeBytes:           maxSizeMegabytes * MEGABYTES,
+			maxEntries:             maxEntries,
+			writeInterval:          writeInterval,
+			maxAge:                 time.Duration(namespaceCfg.MaxAgeSecs) * time.Second,
+			inMemoryThresholdBytes: inMemoryThreshold,
+			walPath:                filepath.Join(expandPlaceholders(walDir), segmentName+".wal"),
+			casPrefix:              namespaceCfg.CasPrefix,
+			casDir:                 casDir,
+			casGCInterval:          time.Duration(namespaceCfg.CasGCIntervalSecs) * time.Second,
+			casInflight:            map[string]int{},
+			waiters:                map[string][]chan struct{}{},
+		}
+	}
+}
+
 func main() {
-	cachedStore.Start()
+	loadCaches()
+	for namespace, store := range caches {
+		if err := store.openWAL(); err != nil {
+			log.Fatalf("error opening wal for namespace \"%s\": %s\n", namespace, err)
+		}
+		if err := store.replayWAL(); err != nil {
+			log.Fatalf("error replaying wal for namespace \"%s\": %s\n", namespace, err)
+		}
+		store.Start()
+	}
 
 	http.HandleFunc("/", mainRoute)
 
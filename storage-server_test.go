@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCachedFs(t *testing.T, maxEntries int) *cachedFs {
+	t.Helper()
+	return &cachedFs{
+		cache:                  map[string]*cachedEntry{},
+		maxEntries:             maxEntries,
+		maxAge:                 -1,
+		inMemoryThresholdBytes: 1 * MEGABYTES,
+		pathLocks:              newKeyedMutex(),
+		waiters:                map[string][]chan struct{}{},
+	}
+}
+
+// addClean inserts a non-dirty entry straight into the cache and the
+// eviction heap, bypassing Write/the flush loop, so eviction behavior can be
+// tested without waiting on a background goroutine.
+func addClean(c *cachedFs, key string, data []byte, accessCount int) {
+	entry := &cachedEntry{
+		key:                    key,
+		accessCount:            accessCount,
+		data:                   data,
+		needsToBeWrittenOnDisk: false,
+		heapIndex:              -1,
+	}
+	c.cache[key] = entry
+	c.totalBytes += uint64(len(data))
+	c.markEvictable(entry)
+}
+
+// TestEvictionPrefersLeastAccessed fills the cache past maxEntries and checks
+// that the entry with the lowest accessCount is the one evicted.
+func TestEvictionPrefersLeastAccessed(t *testing.T) {
+	c := newTestCachedFs(t, 2)
+
+	addClean(c, "cold", []byte("cold"), 0)
+	addClean(c, "hot", []byte("hot"), 5)
+
+	c.rwlock.Lock()
+	c.evict(uint64(len("third")))
+	addClean(c, "third", []byte("third"), 1)
+	c.rwlock.Unlock()
+
+	if _, exists := c.cache["cold"]; exists {
+		t.Errorf("expected \"cold\" to be evicted, but it's still cached")
+	}
+	if _, exists := c.cache["hot"]; !exists {
+		t.Errorf("expected \"hot\" to remain cached")
+	}
+	if _, exists := c.cache["third"]; !exists {
+		t.Errorf("expected \"third\" to remain cached")
+	}
+}
+
+// TestEvictionNeverDropsDirtyEntries checks that evict lets the cache grow
+// past maxEntries rather than discard an entry that hasn't been flushed to
+// disk yet.
+func TestEvictionNeverDropsDirtyEntries(t *testing.T) {
+	c := newTestCachedFs(t, 1)
+
+	for i := 0; i < 3; i++ {
+		entry := &cachedEntry{
+			key:                    filepath.Join("dirty", string(rune('a'+i))),
+			data:                   []byte("x"),
+			needsToBeWrittenOnDisk: true,
+			heapIndex:              -1,
+		}
+		c.cache[entry.key] = entry
+		c.totalBytes += uint64(len(entry.data))
+		// Dirty entries are intentionally never pushed onto the eviction
+		// heap (see markEvictable), so evict can't pick them as victims.
+	}
+
+	c.rwlock.Lock()
+	c.evict(1)
+	c.rwlock.Unlock()
+
+	if len(c.cache) != 3 {
+		t.Errorf("expected all 3 dirty entries to survive eviction, got %d left", len(c.cache))
+	}
+}
+
+// TestReadHitBumpsAccessCount ensures a cache hit increases accessCount, so a
+// frequently-read entry outranks one that's never re-read for eviction.
+func TestReadHitBumpsAccessCount(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestCachedFs(t, 10)
+	path := filepath.Join(dir, "doc")
+
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("seed file: %v", err)
+	}
+	if _, _, err := c.Read(path); err != nil {
+		t.Fatalf("read (populate cache): %v", err)
+	}
+
+	before := c.cache[path].accessCount
+	if _, _, err := c.Read(path); err != nil {
+		t.Fatalf("read (hit): %v", err)
+	}
+	after := c.cache[path].accessCount
+
+	if after <= before {
+		t.Errorf("expected accessCount to increase on read hit, got %d -> %d", before, after)
+	}
+}
+
+// TestWriteThenReadRoundTrips is a small sanity check that Write's cached
+// bytes are what Read serves back, independent of the eviction policy.
+func TestWriteThenReadRoundTrips(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestCachedFs(t, 10)
+	path := filepath.Join(dir, "doc")
+
+	// Write doesn't flush synchronously (that's the background janitor's
+	// job), so seed an older copy on disk: Read then finds the file, and has
+	// to prefer the newer cached bytes over the stale on-disk contents.
+	if err := os.WriteFile(path, []byte("stale"), 0644); err != nil {
+		t.Fatalf("seed file: %v", err)
+	}
+	if err := c.Write(path, bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	blob, _, err := c.Read(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	defer blob.Close()
+
+	got := make([]byte, blob.Size())
+	if _, err := blob.ReadAt(got, 0); err != nil {
+		t.Fatalf("read blob: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("expected \"hello\", got %q", got)
+	}
+}
+
+// TestPostThenImmediateGetServesFromCache guards against a regression where
+// a GET for a path that had just been POSTed, but not yet flushed to disk by
+// the background janitor, 404'd instead of being served from the cache.
+func TestPostThenImmediateGetServesFromCache(t *testing.T) {
+	c := newTestCachedFs(t, 10)
+	c.dir = t.TempDir()
+
+	savedCaches := caches
+	caches = map[string]*cachedFs{defaultNamespace: c}
+	defer func() { caches = savedCaches }()
+
+	postRec := httptest.NewRecorder()
+	mainRoute(postRec, httptest.NewRequest(http.MethodPost, "/doc", strings.NewReader("hello")))
+	if postRec.Code != http.StatusOK {
+		t.Fatalf("post: expected 200, got %d", postRec.Code)
+	}
+
+	getRec := httptest.NewRecorder()
+	mainRoute(getRec, httptest.NewRequest(http.MethodGet, "/doc", nil))
+	if getRec.Code != http.StatusOK {
+		t.Fatalf("get: expected 200, got %d", getRec.Code)
+	}
+	if getRec.Body.String() != "hello" {
+		t.Errorf("expected body %q, got %q", "hello", getRec.Body.String())
+	}
+}
+
+// TestSubscribeWakesOnWrite checks that a subscriber blocked on a path is
+// not woken before any write, and is woken by the next Write to that path.
+func TestSubscribeWakesOnWrite(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestCachedFs(t, 10)
+	path := filepath.Join(dir, "doc")
+
+	ch, _ := c.subscribe(path)
+
+	select {
+	case <-ch:
+		t.Fatalf("subscriber fired before any write happened")
+	default:
+	}
+
+	if err := c.Write(path, bytes.NewReader([]byte("v1"))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("subscriber was never woken up by the write")
+	}
+}
+
+// TestSubscribeCancelRemovesWaiter checks that a canceled subscription
+// doesn't linger in c.waiters, so an idle long-polled document's waiter list
+// doesn't grow without bound.
+func TestSubscribeCancelRemovesWaiter(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestCachedFs(t, 10)
+	path := filepath.Join(dir, "doc")
+
+	_, cancel := c.subscribe(path)
+	if len(c.waiters[path]) != 1 {
+		t.Fatalf("expected 1 waiter right after subscribe, got %d", len(c.waiters[path]))
+	}
+
+	cancel()
+
+	if _, exists := c.waiters[path]; exists {
+		t.Errorf("expected canceled waiter to be removed from c.waiters, but the entry is still present")
+	}
+}
+
+// TestCasPathRejectsTraversal checks that a digest which isn't a well-formed
+// SHA-256 hex string (e.g. one smuggling a "../" path escape) never reaches
+// filepath.Join, so GetCAS/HasCAS can't be tricked into serving or probing
+// files outside casDir.
+func TestCasPathRejectsTraversal(t *testing.T) {
+	c := newTestCachedFs(t, 10)
+	c.casDir = filepath.Join(t.TempDir(), "cas")
+
+	for _, digest := range []string{
+		"../other-users-secret.excalidraw",
+		"..",
+		"",
+		"abcd",
+		strings.Repeat("g", 64), // right length, not hex
+	} {
+		if path := c.casPath(digest); path != "" {
+			t.Errorf("casPath(%q) = %q, expected \"\" for an invalid digest", digest, path)
+		}
+		if c.HasCAS(digest) {
+			t.Errorf("HasCAS(%q) = true, expected false for an invalid digest", digest)
+		}
+	}
+}
+
+// TestGcCASRequiresTwoConsecutivePasses checks that an unreferenced blob
+// survives the pass that first notices it and is only removed on the next
+// one, which is what lets gcCAS skip locking casInflight across the whole
+// scan without racing an upload that's still mid-flight.
+func TestGcCASRequiresTwoConsecutivePasses(t *testing.T) {
+	c := newTestCachedFs(t, 10)
+	c.dir = t.TempDir()
+	c.casPrefix = "blobs"
+	c.casDir = filepath.Join(c.dir, "cas-store")
+	c.casInflight = map[string]int{}
+	if err := os.MkdirAll(filepath.Join(c.dir, c.casPrefix), 0755); err != nil {
+		t.Fatalf("mkdir pointer root: %v", err)
+	}
+
+	digest := strings.Repeat("a", 64)
+	if err := atomicWriteFile(c.casPath(digest), []byte("blob")); err != nil {
+		t.Fatalf("seed blob: %v", err)
+	}
+
+	c.gcCAS()
+	if !c.HasCAS(digest) {
+		t.Fatalf("expected blob to survive its first unreferenced sighting")
+	}
+
+	c.gcCAS()
+	if c.HasCAS(digest) {
+		t.Errorf("expected blob to be removed on its second unreferenced sighting")
+	}
+}
+
+// TestReplayWALRestoresFileAndCache simulates a crash right after a Write
+// durably logs to the WAL but before the background janitor flushes it to
+// disk: a fresh cachedFs opened against the same walPath should recover both
+// the on-disk file and the in-memory cache entry from replayWAL alone.
+func TestReplayWALRestoresFileAndCache(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "test.wal")
+	path := filepath.Join(dir, "doc")
+
+	c := newTestCachedFs(t, 10)
+	c.walPath = walPath
+	if err := c.openWAL(); err != nil {
+		t.Fatalf("openWAL: %v", err)
+	}
+	if err := c.Write(path, bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	recovered := newTestCachedFs(t, 10)
+	recovered.walPath = walPath
+	if err := recovered.openWAL(); err != nil {
+		t.Fatalf("openWAL (recovered): %v", err)
+	}
+	if err := recovered.replayWAL(); err != nil {
+		t.Fatalf("replayWAL: %v", err)
+	}
+
+	diskContents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read replayed file: %v", err)
+	}
+	if string(diskContents) != "hello" {
+		t.Errorf("expected replayed file to contain %q, got %q", "hello", diskContents)
+	}
+
+	entry, exists := recovered.cache[path]
+	if !exists {
+		t.Fatalf("expected replayWAL to populate the cache entry for %q", path)
+	}
+	if string(entry.data) != "hello" {
+		t.Errorf("expected cache entry to contain %q, got %q", "hello", entry.data)
+	}
+}
+
+// TestLoadCachesMergesNamespaceDefaults guards against a regression where a
+// namespace present in the config file, but omitting some fields, had those
+// fields reset to the Go zero value instead of falling back to the default
+// every namespace otherwise gets.
+func TestLoadCachesMergesNamespaceDefaults(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "excalidraw.json")
+	config := `{
+		"caches": {
+			"": {"dir": ":dataDir"},
+			"drawings": {"dir": ":cacheDir/drawings", "maxAgeSeconds": -1}
+		}
+	}`
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	t.Setenv("EXCALIDRAW_CONFIG", configPath)
+	savedCaches := caches
+	caches = map[string]*cachedFs{}
+	defer func() { caches = savedCaches }()
+
+	loadCaches()
+
+	def, ok := caches[defaultNamespace]
+	if !ok {
+		t.Fatalf("expected default namespace to be loaded")
+	}
+	if def.maxAge != -1*time.Second {
+		t.Errorf("expected default namespace's omitted maxAgeSeconds to fall back to -1 (forever), got %v", def.maxAge)
+	}
+
+	drawings, ok := caches["drawings"]
+	if !ok {
+		t.Fatalf("expected \"drawings\" namespace to be loaded")
+	}
+	if drawings.maxSizeBytes != 15*MEGABYTES {
+		t.Errorf("expected \"drawings\"'s omitted maxSizeMegabytes to fall back to 15MB, got %d bytes", drawings.maxSizeBytes)
+	}
+}